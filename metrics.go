@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jsha/ocsp-crawl/verifier"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsAddr = flag.String("metrics-addr", "", "address to serve Prometheus metrics on, e.g. :9090 (disabled if empty)")
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ocsp_request_duration_seconds",
+		Help: "OCSP request latency, by responder, method, and resulting status.",
+	}, []string{"responder", "method", "status"})
+
+	responsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_responses_total",
+		Help: "Count of OCSP responses received, by responder and status.",
+	}, []string{"responder", "status"})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ocsp_errors_total",
+		Help: "Count of OCSP fetch errors, by responder and error kind.",
+	}, []string{"responder", "kind"})
+
+	responseAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ocsp_response_age_seconds",
+		Help: "Age of the most recently-seen OCSP response's ThisUpdate, by responder.",
+	}, []string{"responder"})
+
+	nextUpdateSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ocsp_next_update_seconds",
+		Help: "Time until the most recently-seen OCSP response's NextUpdate, by responder.",
+	}, []string{"responder"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, responsesTotal, errorsTotal, responseAge, nextUpdateSeconds)
+}
+
+// serveMetrics starts an HTTP server exposing the collectors above at
+// addr's /metrics endpoint, if addr is non-empty. It runs for the
+// lifetime of the process; a failure to bind is fatal since an operator
+// relying on -metrics-addr for alerting would rather know immediately.
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Fprintf(os.Stderr, "metrics server on %s: %s\n", addr, err)
+			os.Exit(1)
+		}
+	}()
+}
+
+// recordMetrics publishes datum's leaf OCSP result into the Prometheus
+// collectors above.
+func recordMetrics(datum data) {
+	if len(datum.chainStatuses) == 0 {
+		return
+	}
+	leaf := datum.chainStatuses[0]
+	status := ocspStatusLabel(leaf)
+	if leaf.Method != "" {
+		requestDuration.WithLabelValues(leaf.Responder, leaf.Method, status).Observe(leaf.Latency.Seconds())
+	}
+	if leaf.Err != nil {
+		errorsTotal.WithLabelValues(leaf.Responder, "fetch").Inc()
+		return
+	}
+	responsesTotal.WithLabelValues(leaf.Responder, status).Inc()
+	responseAge.WithLabelValues(leaf.Responder).Set(time.Since(leaf.Response.ThisUpdate).Seconds())
+	nextUpdateSeconds.WithLabelValues(leaf.Responder).Set(time.Until(leaf.Response.NextUpdate).Seconds())
+}
+
+func ocspStatusLabel(cs verifier.CertStatus) string {
+	if cs.Err != nil {
+		return "error"
+	}
+	if cs.Response == nil {
+		return "unknown"
+	}
+	return statuses[cs.Response.Status]
+}
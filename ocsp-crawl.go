@@ -6,6 +6,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/hex"
@@ -13,20 +15,51 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jsha/certificatetransparency"
+	"github.com/jsha/ocsp-crawl/ocspcache"
+	"github.com/jsha/ocsp-crawl/ratelimit"
+	"github.com/jsha/ocsp-crawl/verifier"
 	"golang.org/x/crypto/ocsp"
 )
 
+// maxGETRequestSize is the largest base64-encoded OCSP request that RFC 6960
+// Appendix A.1 allows to be sent as a GET URL path segment.
+const maxGETRequestSize = 255
+
+// delegatedCertExpiryWarning is how far ahead of a delegated OCSP-signing
+// certificate's expiry processData starts warning about it; responders
+// commonly fail to rotate these until they're already expired.
+const delegatedCertExpiryWarning = 7 * 24 * time.Hour
+
 var logURL = flag.String("url", "https://log.certly.io", "url of CT log")
 var logKey = flag.String("key", "MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAECyPLhWKYYUgEc+tUXfPQB4wtGS2MNvXrjwFCCnyYJifBtd2Sk7Cu+Js9DNhMTh35FftHaHu6ZrclnNBKwmbbSA==", "base64-encoded CT log key")
 var fileName = flag.String("file", "certly.log", "file in which to cache log data.")
 var v = flag.Bool("v", false, "verbose")
 var skipUpdate = flag.Bool("skip-update", false, "skip update")
+var ocspCacheFile = flag.String("ocsp-cache", "", "file of cached OCSP responses to read and append to (disabled if empty)")
+var workers = flag.Int("workers", 10, "number of concurrent OCSP-fetching workers")
+var qpsPerHost = flag.Float64("qps-per-host", 5, "max OCSP requests per second to any single responder host (0 disables limiting)")
+var hashAlg = flag.String("hash", "sha1", "hash algorithm for the OCSP request CertID (sha1 or sha256)")
+
+// requestHash maps -hash to the crypto.Hash CreateRequest expects,
+// defaulting to SHA-1 (the package's own default) for any unrecognized
+// value.
+func requestHash() crypto.Hash {
+	switch *hashAlg {
+	case "sha256":
+		return crypto.SHA256
+	default:
+		return crypto.SHA1
+	}
+}
 
 type data struct {
 	serial      string
@@ -37,6 +70,17 @@ type data struct {
 	ocspErr     error
 	names       []string
 	url         string
+	method      string
+	responder   string
+	// chainStatuses holds the leaf's own OCSP result at index 0, followed
+	// by the result for each intermediate up to (but not including) the
+	// root, so processData can tell leaf revocations from intermediate
+	// ones.
+	chainStatuses []verifier.CertStatus
+	// delegatedCertExpiry is the NotAfter of the leaf's OCSP response's
+	// delegated signing certificate, if the responder used one; zero if
+	// the response was signed directly by the issuer.
+	delegatedCertExpiry time.Time
 }
 
 var statuses map[int]string = make(map[int]string, 4)
@@ -104,103 +148,281 @@ func main() {
 		entriesFile.Seek(0, 0)
 	}
 
-	dataChan := make(chan data)
+	var ocspCache *ocspcache.File
+	if *ocspCacheFile != "" {
+		ocspCache, err = ocspcache.NewFile(*ocspCacheFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load OCSP cache: %s\n", err)
+			os.Exit(1)
+		}
+	}
 
-	go func() {
-		entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
-			if err != nil {
-				return
-			}
+	serveMetrics(*metricsAddr)
 
-			cert, err := x509.ParseCertificate(ent.Entry.X509Cert)
-			if err != nil {
-				return
-			}
-			if cert.Issuer.CommonName != "Let's Encrypt Authority X1" {
-				return
-			}
-			if time.Now().After(cert.NotAfter) {
-				return
-			}
+	issuerCache := verifier.NewIssuerCache()
+	hostLimiter := ratelimit.NewHostLimiter(*qpsPerHost)
 
-			var issuer *x509.Certificate
-			if len(ent.Entry.ExtraCerts) > 0 {
-				issuer, err = x509.ParseCertificate(ent.Entry.ExtraCerts[0])
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Failed to parse issuer: %s\n", err)
-					return
-				}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	go func() {
+		if _, ok := <-sigChan; ok {
+			fmt.Fprintln(os.Stderr, "Interrupted, draining outstanding requests...")
+			cancel()
+		}
+	}()
+	defer signal.Stop(sigChan)
+
+	// fetchAndCache is the verifier.FetchFunc used for every hop of a
+	// chain walk: it consults ocspCache (if enabled) before issuing a
+	// network request, and appends freshly-fetched responses back to it.
+	fetchAndCache := func(ctx context.Context, c, iss *x509.Certificate) (*ocsp.Response, string, string, time.Duration, error) {
+		if ocspCache != nil {
+			if _, parsed, ok := ocspCache.Response(c.SerialNumber); ok && time.Now().Before(parsed.NextUpdate) {
+				return parsed, "cache", "", 0, nil
 			}
-			if len(cert.OCSPServer) == 0 {
-				if cert.Issuer.CommonName != "Merge Delay Intermediate 1" {
-					fmt.Fprintf(os.Stderr, "No OCSP Server for %s\n", cert.Issuer.CommonName)
+		}
+		if len(c.OCSPServer) == 0 {
+			return nil, "", "", 0, fmt.Errorf("no OCSP server for %s", c.Subject)
+		}
+		req, err := ocsp.CreateRequest(c, iss, &ocsp.RequestOptions{Hash: requestHash()})
+		if err != nil {
+			return nil, "", "", 0, fmt.Errorf("creating OCSP request: %s", err)
+		}
+		der, method, responder, latency, err := fetchOCSP(ctx, hostLimiter, req, c.OCSPServer)
+		if err != nil {
+			return nil, method, responder, latency, err
+		}
+		// ParseResponseForCert (rather than ParseResponse) validates and
+		// accepts a delegated OCSP-signing certificate embedded in the
+		// response, verifying it chains to iss; the check below requires
+		// that certificate to carry the id-kp-OCSPSigning EKU.
+		parsed, err := ocsp.ParseResponseForCert(der, c, iss)
+		if err != nil {
+			return nil, method, responder, latency, fmt.Errorf("parsing OCSP response: %s", err)
+		}
+		if parsed.Certificate != nil {
+			ocspSigning := false
+			for _, eku := range parsed.Certificate.ExtKeyUsage {
+				if eku == x509.ExtKeyUsageOCSPSigning {
+					ocspSigning = true
 				}
-				return
 			}
-			ocspServer := cert.OCSPServer[0]
-			req, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{})
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error creating OCSP request: %s\n", err)
-				return
-			}
-			url := fmt.Sprintf("%s%s", ocspServer, base64.StdEncoding.EncodeToString(req))
-			start := time.Now()
-			httpResponse, err := http.Post(ocspServer, "application/ocsp-request", bytes.NewBuffer(req))
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error fetching OCSP: %s %s\n", err, url)
-				return
+			if !ocspSigning {
+				return nil, method, responder, latency, fmt.Errorf("delegated OCSP signing certificate %s lacks the id-kp-OCSPSigning EKU", parsed.Certificate.Subject)
 			}
-			defer httpResponse.Body.Close()
-			datum := data{
-				serial:      fmt.Sprintf("%032x", cert.SerialNumber),
-				names:       cert.DNSNames,
-				ocspLatency: time.Now().Sub(start),
-				notBefore:   cert.NotBefore,
-				url:         url,
-			}
-			if datum.ocspLatency > time.Second {
-				fmt.Printf("slow response (%dms) for %x: %s\n", datum.ocspLatency/time.Millisecond, cert.SerialNumber, url)
-			}
-			names := strings.Join(cert.DNSNames, ", ")
-			if err != nil {
-				datum.ocspErr = fmt.Errorf("error fetching OCSP for %s %s: %s\n", names, url, err)
-				dataChan <- datum
-				return
+		}
+		if ocspCache != nil {
+			if err := ocspCache.Append(c.SerialNumber, der); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to append OCSP response to cache: %s\n", err)
 			}
-			ocspResponse, err := ioutil.ReadAll(httpResponse.Body)
+		}
+		return parsed, method, responder, latency, nil
+	}
+
+	// entryChan feeds the worker pool below; it's fed from entriesFile.Map
+	// in a single producer goroutine, since Map itself isn't safe to call
+	// concurrently.
+	entryChan := make(chan *certificatetransparency.EntryAndPosition, *workers*4)
+	go func() {
+		defer close(entryChan)
+		entriesFile.Map(func(ent *certificatetransparency.EntryAndPosition, err error) {
 			if err != nil {
-				datum.ocspErr = fmt.Errorf("error reading OCSP for %s %s: %s\n", names, url, err)
-				dataChan <- datum
 				return
 			}
-			parsedResponse, err := ocsp.ParseResponse(ocspResponse, issuer)
-			if err != nil {
-				datum.ocspErr = fmt.Errorf("error parsing OCSP response for %s %s: %s\n", names, url, err)
-				dataChan <- datum
-				return
+			select {
+			case entryChan <- ent:
+			case <-ctx.Done():
 			}
-			datum.nextUpdate = parsedResponse.NextUpdate
-			datum.thisUpdate = parsedResponse.ThisUpdate
-			dataChan <- datum
 		})
+	}()
+
+	dataChan := make(chan data)
+	var workerWG sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		workerWG.Add(1)
+		go func() {
+			defer workerWG.Done()
+			for ent := range entryChan {
+				processEntry(ctx, ent, issuerCache, fetchAndCache, dataChan)
+			}
+		}()
+	}
+	go func() {
+		workerWG.Wait()
 		close(dataChan)
 	}()
+
 	processData(dataChan)
 }
 
+// processEntry parses ent, filters it down to the Let's Encrypt leaf
+// certificates this crawler cares about, walks its OCSP chain via fetch,
+// and sends the result on dataChan.
+func processEntry(ctx context.Context, ent *certificatetransparency.EntryAndPosition, issuerCache *verifier.IssuerCache, fetch verifier.FetchFunc, dataChan chan<- data) {
+	cert, err := x509.ParseCertificate(ent.Entry.X509Cert)
+	if err != nil {
+		return
+	}
+	if cert.Issuer.CommonName != "Let's Encrypt Authority X1" {
+		return
+	}
+	if time.Now().After(cert.NotAfter) {
+		return
+	}
+
+	var issuer *x509.Certificate
+	if len(ent.Entry.ExtraCerts) > 0 {
+		issuer, err = x509.ParseCertificate(ent.Entry.ExtraCerts[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse issuer: %s\n", err)
+			return
+		}
+	}
+	if len(cert.OCSPServer) == 0 {
+		if cert.Issuer.CommonName != "Merge Delay Intermediate 1" {
+			fmt.Fprintf(os.Stderr, "No OCSP Server for %s\n", cert.Issuer.CommonName)
+		}
+		return
+	}
+
+	names := strings.Join(cert.DNSNames, ", ")
+	chainStatuses := verifier.Chain(ctx, cert, issuer, issuerCache, fetch)
+	leaf := chainStatuses[0]
+	datum := data{
+		serial:        fmt.Sprintf("%032x", cert.SerialNumber),
+		names:         cert.DNSNames,
+		notBefore:     cert.NotBefore,
+		ocspLatency:   leaf.Latency,
+		url:           fmt.Sprintf("%s %s", leaf.Method, leaf.Responder),
+		method:        leaf.Method,
+		responder:     leaf.Responder,
+		chainStatuses: chainStatuses,
+	}
+	if leaf.Err != nil {
+		datum.ocspErr = fmt.Errorf("error fetching OCSP for %s: %s\n", names, leaf.Err)
+		dataChan <- datum
+		return
+	}
+	if datum.ocspLatency > time.Second {
+		fmt.Printf("slow %s response (%dms) for %x: %s\n", leaf.Method, datum.ocspLatency/time.Millisecond, cert.SerialNumber, leaf.Responder)
+	}
+	datum.nextUpdate = leaf.Response.NextUpdate
+	datum.thisUpdate = leaf.Response.ThisUpdate
+	if leaf.Response.Certificate != nil {
+		datum.delegatedCertExpiry = leaf.Response.Certificate.NotAfter
+	}
+	dataChan <- datum
+}
+
 type int64slice []int64
 
 func (a int64slice) Len() int           { return len(a) }
 func (a int64slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a int64slice) Less(i, j int) bool { return a[i] < a[j] }
 
+// fetchOCSP sends req to each server in servers in turn, stopping at the
+// first one that returns a usable response. For requests small enough to
+// fit in a URL (RFC 6960 Appendix A.1) it tries GET before falling back to
+// POST, since GET responses are more likely to be CDN-cached. Before each
+// attempt it waits on limiter for the server's host, so a pool of workers
+// doesn't exceed the configured per-host rate. It returns the raw response
+// bytes along with the method and responder URL that ultimately
+// succeeded, and the latency of that final attempt.
+func fetchOCSP(ctx context.Context, limiter *ratelimit.HostLimiter, req []byte, servers []string) (respBytes []byte, method, responder string, latency time.Duration, err error) {
+	if len(servers) == 0 {
+		return nil, "", "", 0, fmt.Errorf("no OCSP servers given")
+	}
+	encoded := base64.StdEncoding.EncodeToString(req)
+	for _, server := range servers {
+		if len(encoded) <= maxGETRequestSize {
+			start := time.Now()
+			respBytes, err = ocspGET(ctx, limiter, server, encoded)
+			latency = time.Now().Sub(start)
+			if err == nil {
+				return respBytes, "GET", server, latency, nil
+			}
+		}
+		start := time.Now()
+		respBytes, err = ocspPOST(ctx, limiter, server, req)
+		latency = time.Now().Sub(start)
+		if err == nil {
+			return respBytes, "POST", server, latency, nil
+		}
+	}
+	return nil, "", "", latency, err
+}
+
+// hostOf returns the host:port portion of server for use as a rate-limiter
+// key, or server itself if it doesn't parse as a URL.
+func hostOf(server string) string {
+	parsed, err := url.Parse(server)
+	if err != nil || parsed.Host == "" {
+		return server
+	}
+	return parsed.Host
+}
+
+// ocspHTTPTimeout bounds any single OCSP HTTP round trip, so a hung
+// responder can't tie up a worker (and the ctx passed to ocspGET/ocspPOST
+// still aborts the request sooner, on cancellation).
+const ocspHTTPTimeout = 10 * time.Second
+
+var ocspHTTPClient = &http.Client{Timeout: ocspHTTPTimeout}
+
+// ocspGET issues an RFC 6960 Appendix A.1 GET request: the base64-encoded
+// OCSP request, path-escaped, appended to the responder URL.
+func ocspGET(ctx context.Context, limiter *ratelimit.HostLimiter, server, encodedReq string) ([]byte, error) {
+	if err := limiter.Wait(ctx, hostOf(server)); err != nil {
+		return nil, err
+	}
+	reqURL := strings.TrimRight(server, "/") + "/" + url.PathEscape(encodedReq)
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := ocspHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: unexpected status %s", reqURL, httpResponse.Status)
+	}
+	return ioutil.ReadAll(httpResponse.Body)
+}
+
+func ocspPOST(ctx context.Context, limiter *ratelimit.HostLimiter, server string, req []byte) ([]byte, error) {
+	if err := limiter.Wait(ctx, hostOf(server)); err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", server, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpResponse, err := ocspHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: unexpected status %s", server, httpResponse.Status)
+	}
+	return ioutil.ReadAll(httpResponse.Body)
+}
+
 func processData(in <-chan data) {
+	fmt.Printf("Concurrency: %d workers, %.1f qps per responder host\n", *workers, *qpsPerHost)
 	begin := time.Now()
 	var latestIssue time.Time
-	var totalLatency time.Duration
-	latencies := make(int64slice, 10000)
+	latencies := make(int64slice, 0, 10000)
+	perBucket := make(map[string]int64slice)
 	distinct := make(map[string]bool)
+	var leafRevoked, intermediateRevoked int
 	for datum := range in {
+		recordMetrics(datum)
 		if *v {
 			fmt.Printf("%s %s %s\n", datum.notBefore, datum.serial, strings.Join(datum.names, ", "))
 		}
@@ -216,19 +438,64 @@ func processData(in <-chan data) {
 		if begin.Sub(datum.thisUpdate) > time.Hour*24*4 {
 			fmt.Fprintf(os.Stderr, "Out of date response for %s: %s %s\n", datum.serial, datum.thisUpdate, datum.url)
 		}
-		latencies = append(latencies, int64(datum.ocspLatency))
-		totalLatency += datum.ocspLatency
+		if !datum.delegatedCertExpiry.IsZero() && datum.delegatedCertExpiry.Sub(begin) < delegatedCertExpiryWarning {
+			fmt.Fprintf(os.Stderr, "Delegated OCSP signing cert for %s (responder %s) expires soon: %s\n", datum.serial, datum.responder, datum.delegatedCertExpiry)
+		}
+		for i, status := range datum.chainStatuses {
+			if status.Response == nil || status.Response.Status != ocsp.Revoked {
+				continue
+			}
+			if i == 0 {
+				leafRevoked++
+				fmt.Fprintf(os.Stderr, "REVOKED (leaf, %s): %s %s\n", statuses[status.Response.Status], datum.serial, status.Cert.Subject)
+			} else {
+				intermediateRevoked++
+				fmt.Fprintf(os.Stderr, "REVOKED (intermediate, %s): %s %s\n", statuses[status.Response.Status], datum.serial, status.Cert.Subject)
+			}
+		}
+		// Cache hits aren't network measurements: excluding them from
+		// Overall keeps it a latency report, not a hit-rate-weighted
+		// average. They still land in their own "cache" bucket below.
+		if datum.method != "" && datum.method != "cache" {
+			latencies = append(latencies, int64(datum.ocspLatency))
+		}
+		if datum.method != "" {
+			bucket := fmt.Sprintf("%s %s", datum.method, datum.responder)
+			perBucket[bucket] = append(perBucket[bucket], int64(datum.ocspLatency))
+		}
 		distinct[datum.serial] = true
 	}
-	sort.Sort(latencies)
 	timeSinceLatest := begin.Sub(latestIssue)
-	median := time.Duration(latencies[len(latencies)/2])
-	mean := time.Duration(totalLatency / time.Duration(len(latencies)))
-	ninetieth := time.Duration(latencies[int(len(latencies)*9/10)])
-	max := time.Duration(latencies[len(latencies)-1])
 	fmt.Printf("Count: %d %d\n", len(latencies), len(distinct))
 	fmt.Printf("Latest issue: %v\n", timeSinceLatest)
-	fmt.Printf("Latencies: %dms median, %dms mean, %dms 90th, %dms max\n",
-		median/time.Millisecond, mean/time.Millisecond, ninetieth/time.Millisecond,
-		max/time.Millisecond)
+	fmt.Printf("Revoked: %d leaf, %d intermediate\n", leafRevoked, intermediateRevoked)
+	printLatencies("Overall", latencies)
+	buckets := make([]string, 0, len(perBucket))
+	for bucket := range perBucket {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	for _, bucket := range buckets {
+		printLatencies(bucket, perBucket[bucket])
+	}
+}
+
+// printLatencies sorts latencies and prints its median, mean, 90th
+// percentile, and max, labeled with label (e.g. a method+responder pair).
+func printLatencies(label string, latencies int64slice) {
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Sort(latencies)
+	var total int64
+	for _, l := range latencies {
+		total += l
+	}
+	median := time.Duration(latencies[len(latencies)/2])
+	mean := time.Duration(total / int64(len(latencies)))
+	ninetieth := time.Duration(latencies[len(latencies)*9/10])
+	max := time.Duration(latencies[len(latencies)-1])
+	fmt.Printf("Latencies (%s, n=%d): %dms median, %dms mean, %dms 90th, %dms max\n",
+		label, len(latencies), median/time.Millisecond, mean/time.Millisecond,
+		ninetieth/time.Millisecond, max/time.Millisecond)
 }
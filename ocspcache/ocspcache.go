@@ -0,0 +1,119 @@
+// Package ocspcache provides sources of previously-fetched OCSP responses,
+// keyed by certificate serial number, so a crawler can skip responders it
+// has already queried recently and resume an interrupted run.
+package ocspcache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Source looks up a previously-fetched OCSP response for a certificate
+// serial number. The ok return value is false if no response is cached.
+type Source interface {
+	Response(serial *big.Int) (der []byte, parsed *ocsp.Response, ok bool)
+}
+
+// Memory is a Source backed by an in-memory map, keyed by serial number.
+type Memory struct {
+	mu        sync.RWMutex
+	responses map[string][]byte
+}
+
+// NewMemory returns an empty in-memory Source.
+func NewMemory() *Memory {
+	return &Memory{responses: make(map[string][]byte)}
+}
+
+// Response implements Source.
+func (m *Memory) Response(serial *big.Int) ([]byte, *ocsp.Response, bool) {
+	m.mu.RLock()
+	der, ok := m.responses[serial.String()]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, nil, false
+	}
+	parsed, err := ocsp.ParseResponse(der, nil)
+	if err != nil {
+		return nil, nil, false
+	}
+	return der, parsed, true
+}
+
+// Put stores der, a DER-encoded OCSP response, under serial.
+func (m *Memory) Put(serial *big.Int, der []byte) {
+	m.mu.Lock()
+	m.responses[serial.String()] = der
+	m.mu.Unlock()
+}
+
+// File is a Source backed by a file of whitespace-separated, base64-encoded
+// DER OCSP responses. Responses are loaded into memory once, at
+// construction time; Append adds a newly-fetched response to both the
+// in-memory cache and the end of the file, so a later run can resume from
+// where this one left off.
+type File struct {
+	*Memory
+	path string
+	mu   sync.Mutex
+}
+
+// NewFile reads path, which must contain whitespace-separated,
+// base64-encoded DER OCSP responses, and returns a File source backed by
+// it. Entries that fail to decode or parse are skipped with a warning to
+// stderr; a malformed entry does not prevent the rest of the file from
+// loading. It is not an error for path to not exist yet: NewFile returns
+// an empty source, and the file is created on the first call to Append.
+func NewFile(path string) (*File, error) {
+	f := &File{Memory: NewMemory(), path: path}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("reading %s: %s", path, err)
+	}
+
+	for _, field := range strings.Fields(string(contents)) {
+		der, err := base64.StdEncoding.DecodeString(field)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ocspcache: skipping invalid base64 entry in %s: %s\n", path, err)
+			continue
+		}
+		parsed, err := ocsp.ParseResponse(der, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ocspcache: skipping unparseable OCSP response in %s: %s\n", path, err)
+			continue
+		}
+		f.Memory.Put(parsed.SerialNumber, der)
+	}
+	return f, nil
+}
+
+// Append writes der, a DER-encoded OCSP response, to the end of the
+// backing file as a base64-encoded entry, and stores it in the in-memory
+// cache so subsequent Response calls in this process see it immediately.
+func (f *File) Append(serial *big.Int, der []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("opening %s: %s", f.path, err)
+	}
+	defer out.Close()
+
+	if _, err := fmt.Fprintf(out, "%s\n", base64.StdEncoding.EncodeToString(der)); err != nil {
+		return fmt.Errorf("writing %s: %s", f.path, err)
+	}
+	f.Memory.Put(serial, der)
+	return nil
+}
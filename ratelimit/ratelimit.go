@@ -0,0 +1,75 @@
+// Package ratelimit provides a simple per-host rate limiter that spaces out
+// requests at a fixed minimum interval, so a pool of workers hitting the
+// same OCSP responder doesn't exceed a configured request rate to any
+// single host. It has no burst capacity: callers are serialized to exactly
+// one request per interval, never more.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// HostLimiter rate-limits requests per host at a fixed requests-per-second
+// rate, creating a new limiter the first time a host is seen.
+type HostLimiter struct {
+	qps float64
+
+	mu       sync.Mutex
+	limiters map[string]*limiter
+}
+
+// NewHostLimiter returns a HostLimiter that allows qps requests per second
+// to any single host. A non-positive qps disables rate limiting.
+func NewHostLimiter(qps float64) *HostLimiter {
+	return &HostLimiter{qps: qps, limiters: make(map[string]*limiter)}
+}
+
+// Wait blocks until a request to host is allowed to proceed, or returns
+// early with ctx's error if ctx is done first.
+func (h *HostLimiter) Wait(ctx context.Context, host string) error {
+	if h.qps <= 0 {
+		return nil
+	}
+	h.mu.Lock()
+	l, ok := h.limiters[host]
+	if !ok {
+		l = newLimiter(h.qps)
+		h.limiters[host] = l
+	}
+	h.mu.Unlock()
+	return l.wait(ctx)
+}
+
+// limiter spaces out calls to wait so that no two are less than interval
+// apart.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time
+}
+
+func newLimiter(qps float64) *limiter {
+	return &limiter{interval: time.Duration(float64(time.Second) / qps)}
+}
+
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	earliest := l.last.Add(l.interval)
+	if earliest.After(now) {
+		timer := time.NewTimer(earliest.Sub(now))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			now = earliest
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	l.last = now
+	return nil
+}
@@ -0,0 +1,197 @@
+// Package verifier walks a certificate chain from a leaf up to its root,
+// fetching missing issuers over AIA and checking OCSP status at every hop.
+// This lets a crawler tell a leaf revocation apart from an intermediate
+// revocation, which plain leaf-only checking can't do.
+package verifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// maxChainDepth bounds how many issuers Chain will walk up through before
+// giving up, as a guard against AIA loops.
+const maxChainDepth = 10
+
+// aiaHTTPTimeout bounds any single AIA issuer fetch, so a hung CA endpoint
+// can't tie up a worker; ctx still aborts the request sooner, on
+// cancellation.
+const aiaHTTPTimeout = 10 * time.Second
+
+var aiaHTTPClient = &http.Client{Timeout: aiaHTTPTimeout}
+
+// CertStatus is the OCSP result for one certificate in a chain.
+type CertStatus struct {
+	Cert      *x509.Certificate
+	Issuer    *x509.Certificate
+	Response  *ocsp.Response
+	Method    string
+	Responder string
+	Latency   time.Duration
+	Err       error
+}
+
+// FetchFunc performs (or serves from cache) the OCSP check of cert against
+// issuer, returning the parsed response and the method/responder/latency
+// of the attempt that produced it.
+type FetchFunc func(ctx context.Context, cert, issuer *x509.Certificate) (resp *ocsp.Response, method, responder string, latency time.Duration, err error)
+
+// IssuerCache fetches and caches issuer certificates by Subject Key
+// Identifier, so walking many chains that share an intermediate only
+// fetches that intermediate's certificate once. It also caches the OCSP
+// status of each intermediate it's asked about, so a crawl of many leaves
+// under the same intermediate only checks that intermediate's own status
+// once per response validity period (until its NextUpdate; a failed check
+// is retried on the next lookup) instead of once per leaf.
+type IssuerCache struct {
+	mu          sync.Mutex
+	bySKI       map[string]*x509.Certificate
+	statusBySKI map[string]*statusCacheEntry
+}
+
+type statusCacheEntry struct {
+	once   sync.Once
+	status CertStatus
+}
+
+// NewIssuerCache returns an empty IssuerCache.
+func NewIssuerCache() *IssuerCache {
+	return &IssuerCache{
+		bySKI:       make(map[string]*x509.Certificate),
+		statusBySKI: make(map[string]*statusCacheEntry),
+	}
+}
+
+// Issuer returns the issuer of cert, preferring a cached certificate with
+// a matching Subject Key Identifier and otherwise fetching it over one of
+// cert's IssuingCertificateURL (AIA) entries.
+func (c *IssuerCache) Issuer(ctx context.Context, cert *x509.Certificate) (*x509.Certificate, error) {
+	if len(cert.AuthorityKeyId) > 0 {
+		c.mu.Lock()
+		cached, ok := c.bySKI[hex.EncodeToString(cert.AuthorityKeyId)]
+		c.mu.Unlock()
+		if ok {
+			return cached, nil
+		}
+	}
+	if len(cert.IssuingCertificateURL) == 0 {
+		return nil, fmt.Errorf("no AIA issuer URL for %s", cert.Subject)
+	}
+	var lastErr error
+	for _, aiaURL := range cert.IssuingCertificateURL {
+		issuer, err := fetchIssuer(ctx, aiaURL)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.bySKI[hex.EncodeToString(issuer.SubjectKeyId)] = issuer
+		c.mu.Unlock()
+		return issuer, nil
+	}
+	return nil, fmt.Errorf("fetching issuer for %s: %s", cert.Subject, lastErr)
+}
+
+// intermediateStatus returns the OCSP status of cert (whose issuer is iss),
+// deduplicating concurrent and repeated lookups for the same intermediate
+// across many leaf chains: the first caller to see a given Subject Key
+// Identifier performs the fetch, and later callers reuse its result until
+// it's past its NextUpdate.
+func (c *IssuerCache) intermediateStatus(ctx context.Context, cert, iss *x509.Certificate, fetch FetchFunc) CertStatus {
+	ski := hex.EncodeToString(cert.SubjectKeyId)
+
+	c.mu.Lock()
+	entry, ok := c.statusBySKI[ski]
+	// An entry whose status.Cert is still nil has a fetch in flight; its
+	// callers wait on entry.once below instead of starting another fetch.
+	done := ok && entry.status.Cert != nil
+	if !ok || (done && (entry.status.Response == nil || !time.Now().Before(entry.status.Response.NextUpdate))) {
+		entry = &statusCacheEntry{}
+		c.statusBySKI[ski] = entry
+	}
+	c.mu.Unlock()
+
+	entry.once.Do(func() {
+		resp, method, responder, latency, err := fetch(ctx, cert, iss)
+		status := CertStatus{
+			Cert: cert, Issuer: iss, Response: resp,
+			Method: method, Responder: responder, Latency: latency, Err: err,
+		}
+		c.mu.Lock()
+		entry.status = status
+		c.mu.Unlock()
+	})
+	return entry.status
+}
+
+func fetchIssuer(ctx context.Context, aiaURL string) (*x509.Certificate, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", aiaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	httpResponse, err := aiaHTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+	der, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Chain walks up from leaf, whose issuer is already known, OCSP-checking
+// every non-root certificate along the way via fetch. The leaf itself is
+// always checked fresh; each intermediate's status is deduplicated across
+// calls via cache, since many leaves typically share the same intermediate.
+// Further issuers are resolved through cache. Chain stops once it reaches a
+// self-signed (root) certificate, runs out of AIA information, or hits
+// maxChainDepth.
+func Chain(ctx context.Context, leaf, issuer *x509.Certificate, cache *IssuerCache, fetch FetchFunc) []CertStatus {
+	var statuses []CertStatus
+	cert, iss := leaf, issuer
+	for depth := 0; depth < maxChainDepth; depth++ {
+		if iss == nil {
+			statuses = append(statuses, CertStatus{Cert: cert, Err: fmt.Errorf("no issuer available for %s", cert.Subject)})
+			break
+		}
+		var status CertStatus
+		if depth == 0 {
+			resp, method, responder, latency, err := fetch(ctx, cert, iss)
+			status = CertStatus{
+				Cert: cert, Issuer: iss, Response: resp,
+				Method: method, Responder: responder, Latency: latency, Err: err,
+			}
+		} else {
+			status = cache.intermediateStatus(ctx, cert, iss, fetch)
+		}
+		statuses = append(statuses, status)
+
+		if isSelfSigned(iss) {
+			break
+		}
+
+		var nextErr error
+		cert = iss
+		iss, nextErr = cache.Issuer(ctx, cert)
+		if nextErr != nil {
+			statuses = append(statuses, CertStatus{Cert: cert, Err: nextErr})
+			break
+		}
+	}
+	return statuses
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject)
+}